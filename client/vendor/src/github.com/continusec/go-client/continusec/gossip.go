@@ -0,0 +1,183 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// GossipSigner signs a gossip submission before it is sent to a remote auditor.
+// Callers typically implement this over whatever private key they use to identify
+// themselves to auditors, e.g. an rsa.PrivateKey or ecdsa.PrivateKey.
+type GossipSigner interface {
+	// Sign returns a signature over digest, along with an identifier for the
+	// public key that verifiers should use to check it.
+	Sign(digest []byte, opts crypto.SignerOpts) (signature []byte, keyID string, err error)
+}
+
+// GossipSubmission is the wire format posted to a GossipServer's /gossip/submit
+// endpoint. It carries everything a remote auditor needs to detect a split view:
+// the tree size and root hash a client observed, together with the inclusion
+// proof that ties that observation back into the append-only tree head log.
+type GossipSubmission struct {
+	// LogName identifies which map or log's tree head log this observation came from.
+	LogName string `json:"log_name"`
+
+	// TreeSize and RootHash are the observed Merkle tree head.
+	TreeSize int64  `json:"tree_size"`
+	RootHash []byte `json:"root_hash"`
+
+	// TreeHeadLogTreeHead and TreeHeadLogProof together show that RootHash at
+	// TreeSize was included in the tree-head log at TreeHeadLogTreeHead's size,
+	// i.e. the same proof already produced inside VerifiedMapState.
+	TreeHeadLogTreeHead LogTreeHead `json:"tree_head_log_tree_head"`
+	TreeHeadLogProof    [][]byte    `json:"tree_head_log_proof"`
+
+	// Timestamp is when the client verified this observation, in Unix seconds.
+	Timestamp int64 `json:"timestamp"`
+
+	// KeyID and Signature authenticate the submission as coming from a client
+	// holding the corresponding private key.
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+}
+
+// digest returns the bytes that KeyID/Signature sign over.
+func (s *GossipSubmission) digest() []byte {
+	h := crypto.SHA256.New()
+	fmt.Fprintf(h, "%s|%d|%x|%d|%x|%d", s.LogName, s.TreeSize, s.RootHash,
+		s.TreeHeadLogTreeHead.TreeSize, s.TreeHeadLogTreeHead.RootHash, s.Timestamp)
+	return h.Sum(nil)
+}
+
+// GossiperOptions controls the behavior of a Gossiper.
+type GossiperOptions struct {
+	// Auditors is the list of base URLs of remote GossipServers to submit to,
+	// e.g. "https://auditor.example.com".
+	Auditors []string
+
+	// Signer signs each submission so that auditors can attribute it to this client.
+	Signer GossipSigner
+
+	// MaxRetries is the number of attempts made against each auditor before giving
+	// up on that auditor for a given Submit call. Defaults to 3.
+	MaxRetries int
+
+	// HTTPClient is used to make requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// Gossiper publishes verified MapTreeStates to one or more remote auditors, so that
+// an equivocating map operator cannot show different, conflicting root hashes to
+// different clients without risking detection. Submit accepts only a MapTreeState;
+// a bare LogTreeHead for a plain log cannot be submitted.
+type Gossiper struct {
+	opts GossiperOptions
+}
+
+// NewGossiper creates a Gossiper that submits to the auditors named in opts.Auditors.
+func NewGossiper(opts GossiperOptions) *Gossiper {
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = 3
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	return &Gossiper{opts: opts}
+}
+
+// Submit signs and submits state (as observed for logName) to every configured
+// auditor, retrying each with exponential backoff. It returns the first error
+// encountered, after exhausting retries, for any auditor - but still attempts
+// all auditors regardless of earlier failures. ctx governs the whole call: if it is
+// cancelled, in-flight and not-yet-attempted auditor submissions are abandoned and
+// ctx.Err() is returned.
+func (self *Gossiper) Submit(ctx context.Context, logName string, state *MapTreeState, proof [][]byte) error {
+	sub := &GossipSubmission{
+		LogName:             logName,
+		TreeSize:            state.TreeSize(),
+		RootHash:            state.MapTreeHead.RootHash,
+		TreeHeadLogTreeHead: state.TreeHeadLogTreeHead,
+		TreeHeadLogProof:    proof,
+		Timestamp:           time.Now().Unix(),
+	}
+
+	sig, keyID, err := self.opts.Signer.Sign(sub.digest(), crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	sub.Signature = sig
+	sub.KeyID = keyID
+
+	body, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, auditor := range self.opts.Auditors {
+		if err := self.submitWithRetry(ctx, auditor, body); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return firstErr
+}
+
+func (self *Gossiper) submitWithRetry(ctx context.Context, auditor string, body []byte) error {
+	backoff := 500 * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt < self.opts.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff *= 2
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, auditor+"/gossip/submit", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := self.opts.HTTPClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return nil
+		}
+		lastErr = fmt.Errorf("continusec: gossip submission to %s failed with status %d", auditor, resp.StatusCode)
+	}
+	return lastErr
+}
@@ -0,0 +1,190 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ErrSplitView is returned by a GossipServer (and reported to its SplitViewCallback,
+// if set) when two submissions for
+// the same log name and tree size carry different root hashes - i.e. the log or map
+// operator has shown different clients different, conflicting views of the tree.
+var ErrSplitView = errors.New("continusec: split view detected - conflicting root hashes at the same tree size")
+
+// ErrUnknownGossipKey is returned when a GossipSubmission's KeyID does not resolve
+// to a known public key.
+var ErrUnknownGossipKey = errors.New("continusec: unknown gossip key id")
+
+// ErrInvalidGossipSignature is returned when a GossipSubmission's Signature does not
+// verify against the public key its KeyID resolves to.
+var ErrInvalidGossipSignature = errors.New("continusec: invalid gossip submission signature")
+
+// GossipKeyVerifier resolves the public key behind a GossipSigner's KeyID and
+// checks a submission's signature against it. A GossipServer will not accept any
+// submission that fails verification.
+type GossipKeyVerifier interface {
+	// Verify returns nil if signature is a valid signature over digest by the key
+	// identified by keyID, ErrUnknownGossipKey if keyID is not recognized, or
+	// ErrInvalidGossipSignature (or another error) otherwise.
+	Verify(keyID string, digest, signature []byte) error
+}
+
+// gossipKey identifies the (log, tree size) pair a submission observes a root hash for.
+type gossipKey struct {
+	logName  string
+	treeSize int64
+}
+
+// GossipServer ingests GossipSubmissions from Gossiper clients, stores the root hash
+// each client observed at each tree size, and cross-checks that no two submissions
+// for the same log name and tree size ever disagree. It is intended to be mounted
+// behind an HTTP server via its Handler method.
+type GossipServer struct {
+	mu       sync.Mutex
+	seen     map[gossipKey][]*GossipSubmission
+	verifier GossipKeyVerifier
+
+	// SplitViewCallback, if set, is invoked whenever a split view is detected,
+	// with both conflicting submissions.
+	SplitViewCallback func(a, b *GossipSubmission)
+}
+
+// NewGossipServer returns an empty GossipServer, ready to accept submissions whose
+// signatures verify against verifier.
+func NewGossipServer(verifier GossipKeyVerifier) *GossipServer {
+	return &GossipServer{
+		seen:     make(map[gossipKey][]*GossipSubmission),
+		verifier: verifier,
+	}
+}
+
+// Ingest records sub, returning ErrSplitView if a previous submission for the same
+// log name and tree size carried a different root hash. Submissions whose signature
+// does not verify against self.verifier are rejected outright and never recorded.
+func (self *GossipServer) Ingest(sub *GossipSubmission) error {
+	if err := self.verifier.Verify(sub.KeyID, sub.digest(), sub.Signature); err != nil {
+		return err
+	}
+
+	key := gossipKey{logName: sub.LogName, treeSize: sub.TreeSize}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	existing := self.seen[key]
+	for _, prior := range existing {
+		if bytes.Equal(prior.RootHash, sub.RootHash) {
+			// Already seen this exact root hash at this size - nothing new to record.
+			return nil
+		}
+	}
+
+	self.seen[key] = append(existing, sub)
+
+	if len(existing) > 0 {
+		if self.SplitViewCallback != nil {
+			for _, prior := range existing {
+				self.SplitViewCallback(prior, sub)
+			}
+		}
+		return ErrSplitView
+	}
+	return nil
+}
+
+// HeadsAtSize returns every distinct submission previously ingested for logName at
+// the given tree size. In the absence of a split view this will contain at most one
+// entry; it will contain more than one only once conflicting root hashes have
+// actually been observed.
+func (self *GossipServer) HeadsAtSize(logName string, treeSize int64) []*GossipSubmission {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.seen[gossipKey{logName: logName, treeSize: treeSize}]
+}
+
+// Handler returns an http.Handler exposing this GossipServer's endpoints:
+//
+//	POST /gossip/submit       - ingest a GossipSubmission
+//	GET  /gossip/heads/{size} - list observed heads at a given tree size for ?log=name
+func (self *GossipServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/gossip/submit", self.handleSubmit)
+	mux.HandleFunc("/gossip/heads/", self.handleHeads)
+	return mux
+}
+
+func (self *GossipServer) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sub GossipSubmission
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, "invalid submission", http.StatusBadRequest)
+		return
+	}
+
+	if err := self.Ingest(&sub); err != nil {
+		switch err {
+		case ErrSplitView:
+			http.Error(w, err.Error(), http.StatusConflict)
+		case ErrUnknownGossipKey, ErrInvalidGossipSignature:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (self *GossipServer) handleHeads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sizeStr := strings.TrimPrefix(r.URL.Path, "/gossip/heads/")
+	treeSize, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid tree size", http.StatusBadRequest)
+		return
+	}
+
+	logName := r.URL.Query().Get("log")
+	if logName == "" {
+		http.Error(w, "missing log query parameter", http.StatusBadRequest)
+		return
+	}
+
+	heads := self.HeadsAtSize(logName, treeSize)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(heads); err != nil {
+		fmt.Fprintf(w, "{}")
+	}
+}
@@ -0,0 +1,73 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/continusec/go-client/continusec/merkle"
+)
+
+// logConsistencyProofResponse is the JSON body returned for a consistency proof
+// request between two tree sizes of the same log.
+type logConsistencyProofResponse struct {
+	Proof []string `json:"proof"`
+}
+
+// VerifyConsistency proves that cur's tree is prev's tree with only new leaves
+// appended, i.e. that the log has not been tampered with between the two tree
+// heads. Rather than re-fetching and re-hashing every leaf between prev and cur,
+// this wraps prev and cur as merkle.CompactRange values built from their sizes and
+// root hashes alone, and checks the proof fetched from the server against those -
+// using the same merkle package whose CompactRange Monitor uses to compute a running
+// root.
+func (self *VerifiableLog) VerifyConsistency(prev, cur *LogTreeHead) error {
+	if prev.TreeSize == 0 {
+		// Every tree is consistent with the empty tree.
+		return nil
+	}
+	if prev.TreeSize == cur.TreeSize {
+		from := merkle.NewCompactRangeFromRoot(prev.TreeSize, prev.RootHash)
+		to := merkle.NewCompactRangeFromRoot(cur.TreeSize, cur.RootHash)
+		return merkle.VerifyConsistency(from, to, nil)
+	}
+
+	contents, _, err := self.Client.MakeRequest("GET", fmt.Sprintf("/tree/%d/consistency/%d", cur.TreeSize, prev.TreeSize), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	var cpr logConsistencyProofResponse
+	if err := json.Unmarshal(contents, &cpr); err != nil {
+		return err
+	}
+
+	proof := make([][]byte, len(cpr.Proof))
+	for i, p := range cpr.Proof {
+		b, err := hex.DecodeString(p)
+		if err != nil {
+			return err
+		}
+		proof[i] = b
+	}
+
+	from := merkle.NewCompactRangeFromRoot(prev.TreeSize, prev.RootHash)
+	to := merkle.NewCompactRangeFromRoot(cur.TreeSize, cur.RootHash)
+	return merkle.VerifyConsistency(from, to, proof)
+}
@@ -23,6 +23,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -150,6 +151,86 @@ func (self *VerifiableMap) VerifiedGet(key []byte, mapHead *MapTreeState, factor
 	return proof.Value, nil
 }
 
+// BatchOptions controls the behavior of VerifiedGetBatch.
+type BatchOptions struct {
+	// Workers is the number of concurrent Get calls in flight at once. Defaults to 10 if unset.
+	Workers int
+}
+
+// BatchResult is the outcome of looking up a single key within a VerifiedGetBatch call.
+type BatchResult struct {
+	// Key is the key that was looked up, exactly as passed to VerifiedGetBatch.
+	Key []byte
+
+	// Value is the decoded, inclusion-verified entry for Key, set only if Err is nil.
+	Value VerifiableEntry
+
+	// Err is any error encountered looking up or verifying Key, e.g. a failed
+	// inclusion proof. A per-key error does not prevent other keys in the same
+	// batch from succeeding.
+	Err error
+}
+
+// VerifiedGetBatch looks up every key in keys against the single MapTreeHead wrapped
+// by state, fanning the requests out across opts.Workers concurrent goroutines, and
+// verifying each returned MapInclusionProof before returning it. Duplicate keys are
+// looked up only once. factory is normally one of RawDataEntryFactory, JsonEntryFactory
+// or RedactedJsonEntryFactory.
+//
+// This is useful for callers that need to look up many keys against the same map
+// state, e.g. auditing a batch of identities, without either serializing calls to
+// VerifiedGet or hand-rolling their own concurrency around it.
+func (self *VerifiableMap) VerifiedGetBatch(keys [][]byte, state *MapTreeState, factory VerifiableEntryFactory, opts BatchOptions) ([]BatchResult, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = 10
+	}
+
+	// Dedupe identical keys, but preserve an entry (and eventual result) for every
+	// key passed in, in the order given.
+	type job struct {
+		resultIndexes []int
+		key           []byte
+	}
+	jobsByKey := make(map[string]*job)
+	var jobs []*job
+	results := make([]BatchResult, len(keys))
+	for i, key := range keys {
+		results[i].Key = key
+		k := string(key)
+		j, ok := jobsByKey[k]
+		if !ok {
+			j = &job{key: key}
+			jobsByKey[k] = j
+			jobs = append(jobs, j)
+		}
+		j.resultIndexes = append(j.resultIndexes, i)
+	}
+
+	jobCh := make(chan *job)
+	var wg sync.WaitGroup
+	wg.Add(opts.Workers)
+	for w := 0; w < opts.Workers; w++ {
+		go func() {
+			defer wg.Done()
+			for j := range jobCh {
+				value, err := self.VerifiedGet(j.key, state, factory)
+				for _, idx := range j.resultIndexes {
+					results[idx].Value = value
+					results[idx].Err = err
+				}
+			}
+		}()
+	}
+
+	for _, j := range jobs {
+		jobCh <- j
+	}
+	close(jobCh)
+	wg.Wait()
+
+	return results, nil
+}
+
 // Set will generate a map mutation to set the given value for the given key.
 // While this will return quickly, the change will be reflected asynchronously in the map.
 // Returns an AddEntryResponse which contains the leaf hash for the mutation log entry.
@@ -0,0 +1,208 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package merkle implements the client-side Merkle tree math needed to verify
+// RFC 6962 logs incrementally, without holding every leaf in memory.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+)
+
+// ErrConsistencyProofFailed is returned by VerifyConsistency when the supplied proof
+// does not connect from's root to to's root.
+var ErrConsistencyProofFailed = errors.New("merkle: consistency proof verification failed")
+
+// ErrInvalidCompactRange is returned when a CompactRange cannot be unmarshaled.
+var ErrInvalidCompactRange = errors.New("merkle: invalid compact range data")
+
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// CompactRange is a client-side accumulator for an RFC 6962 Merkle tree covering
+// leaves [0, Size()). It stores only the O(log Size()) subtree hashes needed to
+// recompute the root as new leaves are appended, rather than every leaf hash.
+type CompactRange struct {
+	// levels holds, for each power-of-two level, the hash of the complete subtree
+	// at that level if one is currently "open" (i.e. the corresponding bit of size
+	// is set), or nil otherwise. levels[0] is leaf level.
+	levels [][]byte
+	size   int64
+}
+
+// NewCompactRange returns an empty CompactRange, covering zero leaves.
+func NewCompactRange() *CompactRange {
+	return &CompactRange{}
+}
+
+// NewCompactRangeFromRoot returns a CompactRange that knows only its own size and
+// root hash, as received from a server's signed tree head. Its single stored hash is
+// the root, not a leaf-level subtree, so calling Append on it does not yield a valid
+// range; it is sufficient to use as either side of VerifyConsistency.
+func NewCompactRangeFromRoot(size int64, root []byte) *CompactRange {
+	return &CompactRange{size: size, levels: [][]byte{root}}
+}
+
+// Size returns the number of leaves appended to this range so far.
+func (c *CompactRange) Size() int64 {
+	return c.size
+}
+
+// Append adds a new leaf hash to the right-hand edge of the range, updating the
+// stored subtree hashes. leafHash is assumed to already be the RFC 6962 leaf hash
+// (i.e. SHA256(0x00 || data)), as produced by the log client.
+func (c *CompactRange) Append(leafHash []byte) {
+	h := leafHash
+	level := 0
+	for level < len(c.levels) && c.levels[level] != nil {
+		h = hashChildren(c.levels[level], h)
+		c.levels[level] = nil
+		level++
+	}
+	if level == len(c.levels) {
+		c.levels = append(c.levels, nil)
+	}
+	c.levels[level] = h
+	c.size++
+}
+
+// Root returns the Merkle root hash for the leaves seen so far, or nil if no
+// leaves have been appended. Per RFC 6962, the rightmost (most recently opened,
+// lowest-level) subtree is always the right child of everything to its left, so
+// the fold must start at the lowest open level and work upward, not the reverse.
+func (c *CompactRange) Root() []byte {
+	var hash []byte
+	for level := 0; level < len(c.levels); level++ {
+		if c.levels[level] == nil {
+			continue
+		}
+		if hash == nil {
+			hash = c.levels[level]
+		} else {
+			hash = hashChildren(c.levels[level], hash)
+		}
+	}
+	return hash
+}
+
+// compactRangeJSON is the on-the-wire representation used by Marshal/Unmarshal.
+type compactRangeJSON struct {
+	Size   int64    `json:"size"`
+	Levels [][]byte `json:"levels"`
+}
+
+// Marshal serializes this CompactRange so that it can be persisted and later
+// restored with Unmarshal.
+func (c *CompactRange) Marshal() ([]byte, error) {
+	return json.Marshal(&compactRangeJSON{
+		Size:   c.size,
+		Levels: c.levels,
+	})
+}
+
+// Unmarshal restores a CompactRange previously serialized with Marshal.
+func (c *CompactRange) Unmarshal(data []byte) error {
+	var crj compactRangeJSON
+	if err := json.Unmarshal(data, &crj); err != nil {
+		return ErrInvalidCompactRange
+	}
+	c.size = crj.Size
+	c.levels = crj.Levels
+	return nil
+}
+
+// VerifyConsistency checks that proof demonstrates that the tree represented by
+// to is a superset-in-order of the tree represented by from, i.e. that to was
+// grown only by appending leaves after from.Size(). Both from and to need only
+// know their own size and be able to produce Root() - in particular to may be
+// constructed with NewCompactRangeFromRoot from a server-supplied STH.
+func VerifyConsistency(from, to *CompactRange, proof [][]byte) error {
+	if from.size == 0 {
+		// Nothing to prove - every tree is consistent with the empty tree.
+		return nil
+	}
+	if from.size == to.size {
+		if !bytes.Equal(from.Root(), to.Root()) {
+			return ErrConsistencyProofFailed
+		}
+		return nil
+	}
+	if from.size > to.size {
+		return ErrConsistencyProofFailed
+	}
+
+	node := from.size - 1
+	lastNode := to.size - 1
+	for node%2 == 1 {
+		node >>= 1
+		lastNode >>= 1
+	}
+
+	var oldHash, newHash []byte
+	if node > 0 {
+		if len(proof) == 0 {
+			return ErrConsistencyProofFailed
+		}
+		oldHash, newHash = proof[0], proof[0]
+		proof = proof[1:]
+	} else {
+		oldHash, newHash = from.Root(), from.Root()
+	}
+
+	for node > 0 {
+		if node%2 == 1 {
+			if len(proof) == 0 {
+				return ErrConsistencyProofFailed
+			}
+			next := proof[0]
+			proof = proof[1:]
+			oldHash = hashChildren(next, oldHash)
+			newHash = hashChildren(next, newHash)
+		} else if node < lastNode {
+			if len(proof) == 0 {
+				return ErrConsistencyProofFailed
+			}
+			next := proof[0]
+			proof = proof[1:]
+			newHash = hashChildren(newHash, next)
+		}
+		node >>= 1
+		lastNode >>= 1
+	}
+
+	for lastNode > 0 {
+		if len(proof) == 0 {
+			return ErrConsistencyProofFailed
+		}
+		next := proof[0]
+		proof = proof[1:]
+		newHash = hashChildren(newHash, next)
+		lastNode >>= 1
+	}
+
+	if !bytes.Equal(oldHash, from.Root()) || !bytes.Equal(newHash, to.Root()) {
+		return ErrConsistencyProofFailed
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/continusec/go-client/continusec/merkle"
+)
+
+// ErrRootMismatch is returned by Monitor.Run if the root computed from sequenced
+// leaves ever disagrees with the root in a signed tree head that claims to cover
+// the same tree size.
+var ErrRootMismatch = errors.New("continusec: computed root did not match signed tree head")
+
+// ErrInvalidMonitorOptions is returned by Monitor.Run if opts.StartIndex is nonzero
+// without a matching opts.InitialRange - see the InitialRange doc comment.
+var ErrInvalidMonitorOptions = errors.New("continusec: MonitorOptions.StartIndex requires a matching InitialRange")
+
+// MonitorOptions controls the behavior of a Monitor created by NewMonitor.
+type MonitorOptions struct {
+	// ChunkSize is the number of leaves requested per fetch. Defaults to 256 if unset.
+	ChunkSize int
+
+	// Workers is the number of goroutines used to fetch chunks in parallel. Defaults to 4 if unset.
+	Workers int
+
+	// StartIndex is the leaf index to begin tailing from. Defaults to 0.
+	StartIndex int64
+
+	// InitialRange seeds the running merkle.CompactRange used to verify sequenced
+	// leaves against each signed tree head. It must already cover leaves
+	// [0, StartIndex) - typically restored via CompactRange.Unmarshal from a
+	// checkpoint saved through a StateStore on a previous run. Required whenever
+	// StartIndex is nonzero; ignored (a fresh, empty range is used) when
+	// StartIndex is zero.
+	InitialRange *merkle.CompactRange
+}
+
+// MatchedEntry is delivered to a Monitor's callback once the leaf it was derived from
+// has been sequenced and verified against a signed tree head.
+type MatchedEntry struct {
+	// LeafIndex is the index of this leaf within the log.
+	LeafIndex int64
+
+	// LeafHash is the Merkle leaf hash for this entry.
+	LeafHash []byte
+
+	// TreeHead is the signed tree head under which this entry's inclusion was verified.
+	TreeHead *LogTreeHead
+}
+
+// chunk is the unit of work produced by a fetch worker and consumed by the sequencer.
+// It is held in a min-heap ordered by startIndex so that the sequencer can process
+// chunks in log order regardless of the order in which fetches complete.
+type chunk struct {
+	startIndex int64
+	leafHashes [][]byte
+	err        error
+}
+
+// chunkHeap is a container/heap.Interface over chunks, ordered by startIndex.
+type chunkHeap []*chunk
+
+func (h chunkHeap) Len() int            { return len(h) }
+func (h chunkHeap) Less(i, j int) bool  { return h[i].startIndex < h[j].startIndex }
+func (h chunkHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *chunkHeap) Push(x interface{}) { *h = append(*h, x.(*chunk)) }
+func (h *chunkHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	rv := old[n-1]
+	*h = old[:n-1]
+	return rv
+}
+
+// Monitor continuously tails new entries from a VerifiableLog, verifying the inclusion
+// of every fetched leaf against a signed tree head before delivering it to a callback.
+// Create one with NewMonitor.
+type Monitor struct {
+	log  *VerifiableLog
+	opts MonitorOptions
+}
+
+// NewMonitor creates a Monitor that tails log, using the given options. Call Run to
+// begin tailing - Run blocks, so callers will normally invoke it in its own goroutine.
+func NewMonitor(log *VerifiableLog, opts MonitorOptions) *Monitor {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 256
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = 4
+	}
+	return &Monitor{log: log, opts: opts}
+}
+
+// errMonitorStopped is a private sentinel a worker's fetch returns once stopCh has
+// been closed, so it can unwind without treating shutdown as a real fetch error.
+var errMonitorStopped = errors.New("continusec: monitor stopped")
+
+// Run tails the log, fetching entries in bounded chunks across opts.Workers goroutines
+// and sequencing them in order. Sequenced leaves are fed into a running merkle.CompactRange
+// rather than being verified one at a time: once enough leaves have been sequenced to
+// reach a signed tree head's size, the running root is compared against that tree head's
+// root hash, and every leaf sequenced since the last such check is delivered to cb in one
+// batch. This means a new STH is only fetched once the current one has been exhausted by
+// the leaves seen so far, rather than once per leaf.
+//
+// Run only returns on a non-recoverable error (e.g. a genuine root mismatch); fetch
+// workers block and retry with backoff when they run past the current end of the log, so
+// Run otherwise keeps tailing indefinitely as the log grows.
+func (self *Monitor) Run(cb func(MatchedEntry)) error {
+	var compact *merkle.CompactRange
+	if self.opts.StartIndex == 0 {
+		compact = merkle.NewCompactRange()
+	} else {
+		compact = self.opts.InitialRange
+		if compact == nil || compact.Size() != self.opts.StartIndex {
+			return ErrInvalidMonitorOptions
+		}
+	}
+
+	chunks := make(chan *chunk)
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(self.opts.Workers)
+
+	nextFetch := self.opts.StartIndex
+	var fetchMu sync.Mutex
+
+	fetchNext := func() int64 {
+		fetchMu.Lock()
+		defer fetchMu.Unlock()
+		start := nextFetch
+		nextFetch += int64(self.opts.ChunkSize)
+		return start
+	}
+
+	for i := 0; i < self.opts.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				start := fetchNext()
+				leafHashes, err := self.fetchChunk(start, self.opts.ChunkSize, stopCh)
+				if err == errMonitorStopped {
+					return
+				}
+				select {
+				case chunks <- &chunk{startIndex: start, leafHashes: leafHashes, err: err}:
+				case <-stopCh:
+					return
+				}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(chunks)
+	}()
+
+	// stopAndDrain tells every worker to stop fetching and discards whatever chunks
+	// are still in flight, so that Run can return promptly on error instead of
+	// leaking up to opts.Workers goroutines (and the log/HTTP state they hold)
+	// blocked trying to send on an unread chunks channel.
+	stopAndDrain := func() {
+		close(stopCh)
+		for range chunks {
+		}
+	}
+
+	h := &chunkHeap{}
+	heap.Init(h)
+
+	nextSequence := self.opts.StartIndex
+	var head *LogTreeHead
+	var pending []MatchedEntry
+
+	for c := range chunks {
+		if c.err != nil {
+			stopAndDrain()
+			return c.err
+		}
+		heap.Push(h, c)
+
+		// Only pop and sequence chunks once we have the one we're waiting on.
+		for h.Len() > 0 && (*h)[0].startIndex == nextSequence {
+			next := heap.Pop(h).(*chunk)
+			for _, lh := range next.leafHashes {
+				compact.Append(lh)
+				pending = append(pending, MatchedEntry{LeafIndex: nextSequence, LeafHash: lh})
+				nextSequence++
+
+				// The STH we're holding only needs replacing once the leaves we've
+				// sequenced have outgrown it - this amortizes the STH fetch (and any
+				// consistency proof it entails) across a whole batch of leaves rather
+				// than paying for it on every single one.
+				if head == nil || compact.Size() > head.TreeSize {
+					newHead, err := self.log.VerifiedLatestTreeHead(head)
+					if err != nil {
+						stopAndDrain()
+						return err
+					}
+					head = newHead
+				}
+
+				if compact.Size() == head.TreeSize {
+					if !bytes.Equal(compact.Root(), head.RootHash) {
+						stopAndDrain()
+						return ErrRootMismatch
+					}
+					for _, m := range pending {
+						m.TreeHead = head
+						cb(m)
+					}
+					pending = pending[:0]
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchChunk retrieves exactly size consecutive leaf hashes starting at start, blocking
+// and retrying with backoff (in the same style as VerifiableMap.BlockUntilSize) while the
+// log has not yet grown to cover the requested range, rather than returning a "not found"
+// style error the first time a fetch runs past the current tree size. It returns
+// errMonitorStopped promptly if stop is closed while waiting.
+func (self *Monitor) fetchChunk(start int64, size int, stop <-chan struct{}) ([][]byte, error) {
+	timeToSleep := time.Second
+	for {
+		select {
+		case <-stop:
+			return nil, errMonitorStopped
+		default:
+		}
+
+		head, err := self.log.TreeHead(Head)
+		if err != nil {
+			return nil, err
+		}
+		if head.TreeSize() >= start+int64(size) {
+			return self.log.FetchLeafHashes(start, start+int64(size))
+		}
+		select {
+		case <-time.After(timeToSleep):
+		case <-stop:
+			return nil, errMonitorStopped
+		}
+		timeToSleep *= 2
+	}
+}
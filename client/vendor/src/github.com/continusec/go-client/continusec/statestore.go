@@ -0,0 +1,230 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StateStore is used to persist the last verified state for a named map or log,
+// so that long-running clients can resume monitoring across restarts without
+// re-verifying from tree size zero. Implementations must be safe to use from
+// multiple goroutines.
+type StateStore interface {
+	// Load returns the previously saved data for name, or (nil, nil) if nothing
+	// has been saved yet.
+	Load(name string) ([]byte, error)
+
+	// Save persists data under name, replacing any previously saved value.
+	Save(name string, data []byte) error
+}
+
+// FileStateStore is a StateStore that persists each named value as a file within
+// a directory, using write-temp-then-rename so that a crash or concurrent reader
+// never observes a partially written file.
+type FileStateStore struct {
+	// Dir is the directory in which state files are stored. It must already exist.
+	Dir string
+}
+
+// NewFileStateStore returns a FileStateStore that persists state under dir. dir
+// must already exist and be writable.
+func NewFileStateStore(dir string) *FileStateStore {
+	return &FileStateStore{Dir: dir}
+}
+
+func (self *FileStateStore) pathFor(name string) string {
+	return filepath.Join(self.Dir, name+".json")
+}
+
+// Load returns the previously saved data for name, or (nil, nil) if nothing has
+// been saved yet.
+func (self *FileStateStore) Load(name string) ([]byte, error) {
+	data, err := ioutil.ReadFile(self.pathFor(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// Save persists data under name. It writes to a temporary file in the same
+// directory first, then renames it into place, so that readers never see a
+// partially written file and a crash mid-write cannot corrupt the prior value.
+func (self *FileStateStore) Save(name string, data []byte) error {
+	finalPath := self.pathFor(name)
+	tmp, err := ioutil.TempFile(self.Dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// mapTreeStateJSON is the on-the-wire representation of a MapTreeState used when
+// persisting it to a StateStore.
+type mapTreeStateJSON struct {
+	MapTreeHead         logTreeHeadJSON `json:"map_tree_head"`
+	MapRootHash         []byte          `json:"map_root_hash"`
+	TreeHeadLogTreeHead logTreeHeadJSON `json:"tree_head_log_tree_head"`
+}
+
+// logTreeHeadJSON is the on-the-wire representation of a LogTreeHead.
+type logTreeHeadJSON struct {
+	TreeSize int64  `json:"tree_size"`
+	RootHash []byte `json:"root_hash"`
+}
+
+func marshalLogTreeHead(lth *LogTreeHead) logTreeHeadJSON {
+	return logTreeHeadJSON{TreeSize: lth.TreeSize, RootHash: lth.RootHash}
+}
+
+func unmarshalLogTreeHead(j logTreeHeadJSON) *LogTreeHead {
+	return &LogTreeHead{TreeSize: j.TreeSize, RootHash: j.RootHash}
+}
+
+// marshalMapTreeState serializes state so that it can be persisted in a StateStore
+// and later restored with unmarshalMapTreeState.
+func marshalMapTreeState(state *MapTreeState) ([]byte, error) {
+	return json.Marshal(&mapTreeStateJSON{
+		MapRootHash:         state.MapTreeHead.RootHash,
+		MapTreeHead:         marshalLogTreeHead(&state.MapTreeHead.MutationLogTreeHead),
+		TreeHeadLogTreeHead: marshalLogTreeHead(&state.TreeHeadLogTreeHead),
+	})
+}
+
+// unmarshalMapTreeState restores a MapTreeState previously serialized with
+// marshalMapTreeState.
+func unmarshalMapTreeState(data []byte) (*MapTreeState, error) {
+	var j mapTreeStateJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	return &MapTreeState{
+		MapTreeHead: MapTreeHead{
+			RootHash:            j.MapRootHash,
+			MutationLogTreeHead: *unmarshalLogTreeHead(j.MapTreeHead),
+		},
+		TreeHeadLogTreeHead: *unmarshalLogTreeHead(j.TreeHeadLogTreeHead),
+	}, nil
+}
+
+// marshalLogTreeHeadState serializes lth for persistence in a StateStore.
+func marshalLogTreeHeadState(lth *LogTreeHead) ([]byte, error) {
+	return json.Marshal(marshalLogTreeHead(lth))
+}
+
+// unmarshalLogTreeHeadState restores a LogTreeHead previously serialized with
+// marshalLogTreeHeadState.
+func unmarshalLogTreeHeadState(data []byte) (*LogTreeHead, error) {
+	var j logTreeHeadJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	return unmarshalLogTreeHead(j), nil
+}
+
+// VerifiedLatestMapStateWithStore behaves like VerifiedLatestMapState, except that
+// instead of taking the previous state as a parameter, it loads it from store under
+// name (if present), and saves the newly verified state back to store under name
+// on success. This allows a long-running client to resume monitoring a map across
+// restarts without re-verifying from tree size zero.
+func (self *VerifiableMap) VerifiedLatestMapStateWithStore(store StateStore, name string) (*MapTreeState, error) {
+	var prev *MapTreeState
+
+	data, err := store.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		prev, err = unmarshalMapTreeState(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	head, err := self.VerifiedLatestMapState(prev)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = marshalMapTreeState(head)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Save(name, data); err != nil {
+		return nil, err
+	}
+
+	return head, nil
+}
+
+// VerifiedLatestTreeHeadWithStore behaves like VerifiedLatestTreeHead, except that
+// instead of taking the previous head as a parameter, it loads it from store under
+// name (if present), and saves the newly verified head back to store under name on
+// success. This allows a long-running client to resume tailing a log across restarts
+// without re-verifying from tree size zero.
+func (self *VerifiableLog) VerifiedLatestTreeHeadWithStore(store StateStore, name string) (*LogTreeHead, error) {
+	var prev *LogTreeHead
+
+	data, err := store.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	if data != nil {
+		prev, err = unmarshalLogTreeHeadState(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	head, err := self.VerifiedLatestTreeHead(prev)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = marshalLogTreeHeadState(head)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Save(name, data); err != nil {
+		return nil, err
+	}
+
+	return head, nil
+}
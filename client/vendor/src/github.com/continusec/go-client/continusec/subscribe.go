@@ -0,0 +1,270 @@
+/*
+   Copyright 2016 Continusec Pty Ltd
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package continusec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Matcher decides whether a given map key/value mutation is of interest to a
+// subscriber. Implementations must be safe to call from multiple goroutines.
+type Matcher interface {
+	// Match returns true if value, found under key, should be delivered to the
+	// subscriber that supplied this Matcher.
+	Match(key []byte, value VerifiableEntry) bool
+}
+
+// KeyPrefixMatcher matches any key with the given prefix, e.g. "user/alice/" to
+// match every key belonging to that user.
+type KeyPrefixMatcher []byte
+
+// Match implements Matcher.
+func (m KeyPrefixMatcher) Match(key []byte, value VerifiableEntry) bool {
+	return bytes.HasPrefix(key, []byte(m))
+}
+
+// ExactKeyMatcher matches only the exact key given.
+type ExactKeyMatcher []byte
+
+// Match implements Matcher.
+func (m ExactKeyMatcher) Match(key []byte, value VerifiableEntry) bool {
+	return bytes.Equal(key, []byte(m))
+}
+
+// JSONFieldEqualsMatcher matches any value that, decoded as JSON, has Field set to
+// the given Value (compared as decoded JSON values, e.g. "1" does not match 1).
+type JSONFieldEqualsMatcher struct {
+	Field string
+	Value interface{}
+}
+
+// Match implements Matcher. Values that fail to decode as a JSON object, or that
+// do not have the field set, never match.
+func (m JSONFieldEqualsMatcher) Match(key []byte, value VerifiableEntry) bool {
+	data, err := value.Data()
+	if err != nil {
+		return false
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return false
+	}
+	fieldValue, ok := decoded[m.Field]
+	if !ok {
+		return false
+	}
+	expected, err := json.Marshal(m.Value)
+	if err != nil {
+		return false
+	}
+	actual, err := json.Marshal(fieldValue)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(expected, actual)
+}
+
+// MutationEvent is delivered to a Subscription's callback whenever a mutation log
+// entry matches the Matcher it was created with.
+type MutationEvent struct {
+	// Key is the map key that was mutated.
+	Key []byte
+
+	// OldLeafHash is the leaf hash of the value prior to this mutation, if known.
+	OldLeafHash []byte
+
+	// NewValue is the decoded, inclusion-verified value of Key after this mutation.
+	NewValue VerifiableEntry
+
+	// MutationLogIndex is the index of the mutation log entry that produced this event.
+	MutationLogIndex int64
+
+	// MapTreeHead is the map tree head under which NewValue's inclusion was verified.
+	MapTreeHead *MapTreeHead
+}
+
+// Subscription represents an in-progress Subscribe call. Cancel stops tailing the
+// mutation log; Err returns the error, if any, that caused tailing to stop.
+type Subscription struct {
+	cancelCh chan struct{}
+	errCh    chan error
+}
+
+// Cancel stops this subscription. It is safe to call more than once.
+func (self *Subscription) Cancel() {
+	select {
+	case <-self.cancelCh:
+		// already cancelled
+	default:
+		close(self.cancelCh)
+	}
+}
+
+// Err blocks until this subscription has stopped (whether due to Cancel or a
+// non-recoverable error), then returns the error that stopped it, or nil if it was
+// cancelled cleanly.
+func (self *Subscription) Err() error {
+	return <-self.errCh
+}
+
+// fail records err as the reason this subscription stopped, if it is the first
+// failure seen, and cancels further processing of matched entries. It is safe to
+// call from multiple goroutines, though Subscribe only ever calls it from one.
+func (self *Subscription) fail(err error) {
+	if err == nil {
+		return
+	}
+	select {
+	case self.errCh <- err:
+		self.Cancel()
+	default:
+		// A failure has already been recorded.
+	}
+}
+
+// Subscribe tails self's mutation log, decoding each entry's resulting map key/value
+// change, then fetching the map state at the corresponding tree size via
+// VerifiedMapState (so it is proven consistent with every state previously verified
+// by this Subscription) and verifying the new value's inclusion under that verified
+// state before invoking cb with a MutationEvent for every change for which
+// matcher.Match returns true. factory is used to decode the fetched value, and is
+// normally one of RawDataEntryFactory, JsonEntryFactory or RedactedJsonEntryFactory.
+//
+// Subscribe returns immediately; tailing happens in a background goroutine until the
+// returned Subscription is cancelled or a non-recoverable error occurs - including a
+// failed inclusion or consistency check, which Subscription.Err() will then return,
+// rather than being silently dropped.
+func (self *VerifiableMap) Subscribe(matcher Matcher, factory VerifiableEntryFactory, opts MonitorOptions, cb func(MutationEvent)) *Subscription {
+	sub := &Subscription{
+		cancelCh: make(chan struct{}),
+		errCh:    make(chan error, 1),
+	}
+
+	monitor := NewMonitor(self.MutationLog(), opts)
+
+	go func() {
+		var state *MapTreeState
+
+		sub.fail(monitor.Run(func(entry MatchedEntry) {
+			select {
+			case <-sub.cancelCh:
+				return
+			default:
+			}
+
+			newState, err := self.handleMutation(state, entry, matcher, factory, cb)
+			if err != nil {
+				sub.fail(err)
+				return
+			}
+			state = newState
+		}))
+	}()
+
+	return sub
+}
+
+// handleMutation decodes the mutation log entry at entry.LeafIndex, verifies the map
+// state at its tree size against prevState, fetches and inclusion-verifies the
+// resulting value, and invokes cb if matcher accepts it. It returns the newly
+// verified MapTreeState so the caller can thread it into the next call.
+func (self *VerifiableMap) handleMutation(prevState *MapTreeState, entry MatchedEntry, matcher Matcher, factory VerifiableEntryFactory, cb func(MutationEvent)) (*MapTreeState, error) {
+	mutation, err := self.fetchMutation(entry.LeafIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// The map tree size that corresponds to this mutation is entry.LeafIndex + 1,
+	// not entry.TreeHead.TreeSize - the latter is the mutation log's STH size, shared
+	// by every MatchedEntry in a Monitor-flushed batch, while map tree size tracks the
+	// mutation log 1:1.
+	state, err := self.VerifiedMapState(prevState, entry.LeafIndex+1)
+	if err != nil {
+		return nil, err
+	}
+
+	proof, err := self.Get(mutation.Key, state.TreeSize(), factory)
+	if err != nil {
+		return nil, err
+	}
+	if err := proof.Verify(&state.MapTreeHead); err != nil {
+		return nil, err
+	}
+
+	if matcher.Match(mutation.Key, proof.Value) {
+		cb(MutationEvent{
+			Key:              mutation.Key,
+			OldLeafHash:      mutation.PreviousLeafHash,
+			NewValue:         proof.Value,
+			MutationLogIndex: entry.LeafIndex,
+			MapTreeHead:      &state.MapTreeHead,
+		})
+	}
+
+	return state, nil
+}
+
+// mapMutation is the decoded form of a mutation log entry, as written by
+// VerifiableMap.Set/Update/Delete.
+type mapMutation struct {
+	Key              []byte
+	PreviousLeafHash []byte
+}
+
+// mutationLogEntryJSON is the on-the-wire format of a mutation log entry.
+type mutationLogEntryJSON struct {
+	Key      string `json:"key"`
+	Previous string `json:"previous_leaf_hash"`
+}
+
+// fetchMutation retrieves and decodes the mutation log entry at index, giving the
+// key it mutated and the leaf hash of the value it replaced, if any. Subscribe takes
+// only these two fields from the mutation - it re-fetches and verifies the resulting
+// value directly from the map, rather than trusting the uploaded value carried by the
+// mutation itself.
+func (self *VerifiableMap) fetchMutation(index int64) (*mapMutation, error) {
+	entry, err := self.MutationLog().Entry(index, RawDataEntryFactory)
+	if err != nil {
+		return nil, err
+	}
+	data, err := entry.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	var raw mutationLogEntryJSON
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(raw.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	var prevLeafHash []byte
+	if raw.Previous != "" {
+		prevLeafHash, err = hex.DecodeString(raw.Previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &mapMutation{Key: key, PreviousLeafHash: prevLeafHash}, nil
+}